@@ -0,0 +1,87 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "time"
+
+// PoolPolicy configures the loader's downstream connection pool: how
+// many connections to keep, and how aggressively to probe and replace
+// ones the downstream has dropped.
+type PoolPolicy struct {
+	// MaxOpen caps how many worker connections createConns opens to the
+	// downstream. Zero (the default) leaves the pool sized to the
+	// loader's worker count.
+	MaxOpen int `toml:"max-open" json:"max-open" yaml:"max-open"`
+
+	// HealthProbeInterval is how often every pool connection is pinged,
+	// including ones a worker is using at that moment; idle connections
+	// are not told apart from busy ones. Zero disables health probing.
+	HealthProbeInterval time.Duration `toml:"health-probe-interval" json:"health-probe-interval" yaml:"health-probe-interval"`
+
+	// PingTimesBeforeEviction is how many consecutive failed pings a
+	// connection tolerates before the pool evicts and rebuilds it.
+	PingTimesBeforeEviction int `toml:"ping-times-before-eviction" json:"ping-times-before-eviction" yaml:"ping-times-before-eviction"`
+}
+
+// DBConfig is the DB configuration.
+type DBConfig struct {
+	Host     string `toml:"host" json:"host" yaml:"host"`
+	Port     int    `toml:"port" json:"port" yaml:"port"`
+	User     string `toml:"user" json:"user" yaml:"user"`
+	Password string `toml:"password" json:"-" yaml:"password"`
+
+	// Backend selects the downstream's SQL dialect, e.g. "mysql" (the
+	// default), "tidb", "mariadb" or "postgres". It controls how the
+	// loader classifies errors and rewrites dump DDL for this
+	// connection; see pkg/conn.Dialect.
+	Backend string `toml:"backend" json:"backend" yaml:"backend"`
+
+	// PoolPolicy controls how the loader sizes and health-checks its
+	// pool of connections to this downstream.
+	PoolPolicy PoolPolicy `toml:"pool-policy" json:"pool-policy" yaml:"pool-policy"`
+}
+
+// LoaderConfig is the configuration for the loader subtask.
+type LoaderConfig struct {
+	PoolSize int    `toml:"pool-size" json:"pool-size" yaml:"pool-size"`
+	Dir      string `toml:"dir" json:"dir" yaml:"dir"`
+
+	// StatementTimeout, when greater than zero, bounds how long a single
+	// query or execute statement issued by the loader may run downstream
+	// before it's aborted. It's applied as a MAX_EXECUTION_TIME(N) hint
+	// for SELECTs and a session-scoped MAX_EXECUTION_TIME for writes, in
+	// seconds. Zero disables the limit.
+	StatementTimeout int `toml:"statement-timeout" json:"statement-timeout" yaml:"statement-timeout"`
+}
+
+// ExperimentalConfig groups features that aren't yet stable enough to
+// turn on by default.
+type ExperimentalConfig struct {
+	// TwoPhaseCommit makes the loader assign each batch a global xid and
+	// commit it via XA across all of a task's downstream connections, so
+	// a crash mid-load can't leave the batch half-applied. See
+	// loader.XACoordinator.
+	TwoPhaseCommit bool `toml:"two-phase-commit" json:"two-phase-commit" yaml:"two-phase-commit"`
+}
+
+// SubTaskConfig is the configuration for a subtask.
+type SubTaskConfig struct {
+	Name string `toml:"name" json:"name" yaml:"name"`
+
+	To DBConfig `toml:"to" json:"to" yaml:"to"`
+
+	Loader LoaderConfig `toml:"loader" json:"loader" yaml:"loader"`
+
+	Experimental ExperimentalConfig `toml:"experimental" json:"experimental" yaml:"experimental"`
+}
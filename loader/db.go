@@ -16,8 +16,11 @@ package loader
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
@@ -38,21 +41,76 @@ import (
 // DBConn represents a live DB connection
 // it's not thread-safe
 type DBConn struct {
-	cfg      *config.SubTaskConfig
-	baseConn *conn.BaseConn
+	cfg     *config.SubTaskConfig
+	dialect conn.Dialect
+
+	// baseConnMu guards baseConn. Everything else on DBConn is set once
+	// at construction and never changes, but baseConn can be swapped out
+	// from under a long-lived DBConn by the pool's background
+	// health-probe goroutine (see connPool.evictAndRebuildLocked), which
+	// runs concurrently with whatever worker owns this connection.
+	baseConnMu sync.Mutex
+	baseConn   *conn.BaseConn
+
+	// pool and poolIndex are set when this connection is managed by a
+	// connPool (see createConns); they let querySQL/executeSQL ask the
+	// pool to replace a connection the moment it looks dead, rather than
+	// waiting for the next health-probe tick.
+	pool      *connPool
+	poolIndex int
+}
+
+// getBaseConn returns c's current baseConn, synchronized against a
+// concurrent evictAndRebuildLocked swapping it out.
+func (c *DBConn) getBaseConn() *conn.BaseConn {
+	c.baseConnMu.Lock()
+	defer c.baseConnMu.Unlock()
+	return c.baseConn
+}
+
+// setBaseConn swaps in a freshly dialed baseConn, synchronized against
+// concurrent readers.
+func (c *DBConn) setBaseConn(baseConn *conn.BaseConn) {
+	c.baseConnMu.Lock()
+	defer c.baseConnMu.Unlock()
+	c.baseConn = baseConn
+}
+
+// withStatementTimeoutHint prefixes query with a MAX_EXECUTION_TIME(N)
+// optimizer hint honoring cfg.Loader.StatementTimeout, so a single slow
+// SELECT can't stall a worker indefinitely. It's a no-op when no timeout
+// is configured, or when query isn't actually a SELECT (querySQL also
+// carries non-SELECT statements like SHOW, which the hint can't prefix
+// without producing invalid SQL).
+func (conn *DBConn) withStatementTimeoutHint(query string) string {
+	timeout := conn.cfg.Loader.StatementTimeout
+	trimmed := strings.TrimSpace(query)
+	if timeout <= 0 || len(trimmed) < len("SELECT") || !strings.EqualFold(trimmed[:len("SELECT")], "SELECT") {
+		return query
+	}
+	return fmt.Sprintf("SELECT /*+ MAX_EXECUTION_TIME(%d) */ %s", timeout*1000, trimmed[len("SELECT"):])
 }
 
 func (conn *DBConn) querySQL(ctx *tcontext.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	if conn == nil || conn.baseConn == nil {
+	if conn == nil || conn.getBaseConn() == nil {
 		return nil, terror.ErrDBUnExpect.Generate("database connection not valid")
 	}
 
+	query = conn.withStatementTimeoutHint(query)
+
+	retryCount := 0
 	params := retry.Params{
 		RetryCount:         10,
 		FirstRetryDuration: time.Second,
 		BackoffStrategy:    retry.Stable,
 		IsRetryableFn: func(retryTime int, err error) bool {
-			if retry.IsRetryableError(err) {
+			retryCount = retryTime
+			if conn.pool != nil && isErrBadConnection(err) {
+				if fresh := conn.pool.replace(ctx, conn.poolIndex); fresh != nil {
+					conn.setBaseConn(fresh.getBaseConn())
+				}
+			}
+			if isErrStatementTimeout(err) || conn.dialect.IsRetryable(err) {
 				ctx.L().Warn("query statement", zap.Int("retry", retryTime),
 					zap.String("query", utils.TruncateString(query, -1)),
 					zap.String("argument", utils.TruncateInterface(args, -1)),
@@ -63,12 +121,21 @@ func (conn *DBConn) querySQL(ctx *tcontext.Context, query string, args ...interf
 		},
 	}
 
-	ret, _, err := conn.baseConn.ApplyRetryStrategy(
+	ret, _, err := retry.ApplyRetryStrategy(
 		ctx,
 		params,
 		func(ctx *tcontext.Context) (interface{}, error) {
+			baseConn := conn.getBaseConn()
+			if baseConn == nil {
+				// A previous retry's pool replace() couldn't redial the
+				// downstream, leaving this connection without a baseConn;
+				// report it the same way a dead connection would so the
+				// next IsRetryableFn call tries replace() again instead
+				// of dereferencing a nil *conn.BaseConn.
+				return nil, driver.ErrBadConn
+			}
 			startTime := time.Now()
-			ret, err := conn.baseConn.QuerySQL(ctx, query, args...)
+			ret, err := baseConn.QuerySQL(ctx, query, args...)
 			if err == nil {
 				cost := time.Since(startTime)
 				queryHistogram.WithLabelValues(conn.cfg.Name).Observe(cost.Seconds())
@@ -86,6 +153,9 @@ func (conn *DBConn) querySQL(ctx *tcontext.Context, query string, args ...interf
 			zap.String("query", utils.TruncateString(query, -1)),
 			zap.String("argument", utils.TruncateInterface(args, -1)),
 			log.ShortError(err))
+		if isErrStatementTimeout(err) {
+			return nil, terror.ErrLoadStatementTimeout.Generate(conn.cfg.Loader.StatementTimeout, retryCount)
+		}
 		return nil, err
 	}
 	return ret.(*sql.Rows), nil
@@ -96,29 +166,68 @@ func (conn *DBConn) executeSQL(ctx *tcontext.Context, queries []string, args ...
 		return nil
 	}
 
-	if conn == nil || conn.baseConn == nil {
+	if conn == nil || conn.getBaseConn() == nil {
 		return terror.ErrDBUnExpect.Generate("database connection not valid")
 	}
 
+	rewritten := make([]string, len(queries))
+	for i, query := range queries {
+		rewritten[i] = conn.dialect.RewriteDDL(query)
+	}
+	queries = rewritten
+
+	timeout := conn.cfg.Loader.StatementTimeout
+	if timeout > 0 {
+		// SET SESSION MAX_EXECUTION_TIME bounds the writes the same way
+		// the MAX_EXECUTION_TIME hint bounds SELECTs in querySQL; each
+		// retry attempt below additionally gets its own fresh timeout
+		// context, so a slow attempt can't eat into the budget of the
+		// attempts that follow it.
+		queries = append([]string{fmt.Sprintf("SET SESSION MAX_EXECUTION_TIME=%d", timeout*1000)}, queries...)
+		args = append([][]interface{}{{}}, args...)
+	}
+
+	retryCount := 0
 	params := retry.Params{
 		RetryCount:         10,
 		FirstRetryDuration: 2 * time.Second,
 		BackoffStrategy:    retry.LinearIncrease,
 		IsRetryableFn: func(retryTime int, err error) bool {
+			retryCount = retryTime
+			if conn.pool != nil && isErrBadConnection(err) {
+				if fresh := conn.pool.replace(ctx, conn.poolIndex); fresh != nil {
+					conn.setBaseConn(fresh.getBaseConn())
+				}
+			}
 			ctx.L().Warn("execute statements", zap.Int("retry", retryTime),
 				zap.String("queries", utils.TruncateInterface(queries, -1)),
 				zap.String("arguments", utils.TruncateInterface(args, -1)),
 				log.ShortError(err))
 			tidbExecutionErrorCounter.WithLabelValues(conn.cfg.Name).Inc()
-			return retry.IsRetryableError(err)
+			return isErrStatementTimeout(err) || conn.dialect.IsRetryable(err)
 		},
 	}
-	_, _, err := conn.baseConn.ApplyRetryStrategy(
+	_, _, err := retry.ApplyRetryStrategy(
 		ctx,
 		params,
 		func(ctx *tcontext.Context) (interface{}, error) {
+			baseConn := conn.getBaseConn()
+			if baseConn == nil {
+				// A previous retry's pool replace() couldn't redial the
+				// downstream, leaving this connection without a baseConn;
+				// report it the same way a dead connection would so the
+				// next IsRetryableFn call tries replace() again instead
+				// of dereferencing a nil *conn.BaseConn.
+				return nil, driver.ErrBadConn
+			}
+			execCtx := ctx
+			if timeout > 0 {
+				timeoutCtx, cancel := context.WithTimeout(ctx.Context(), time.Duration(timeout)*time.Second)
+				defer cancel()
+				execCtx = ctx.WithContext(timeoutCtx)
+			}
 			startTime := time.Now()
-			_, err := conn.baseConn.ExecuteSQL(ctx, queries, args...)
+			_, err := baseConn.ExecuteSQL(execCtx, queries, args...)
 			failpoint.Inject("LoadExecCreateTableFailed", func(val failpoint.Value) {
 				errCode, err1 := strconv.ParseUint(val.(string), 10, 16)
 				if err1 != nil {
@@ -145,6 +254,9 @@ func (conn *DBConn) executeSQL(ctx *tcontext.Context, queries []string, args ...
 			zap.String("queries", utils.TruncateInterface(queries, -1)),
 			zap.String("arguments", utils.TruncateInterface(args, -1)),
 			log.ShortError(err))
+		if isErrStatementTimeout(err) {
+			return terror.ErrLoadStatementTimeout.Generate(conn.cfg.Loader.StatementTimeout, retryCount)
+		}
 	}
 
 	return err
@@ -152,10 +264,10 @@ func (conn *DBConn) executeSQL(ctx *tcontext.Context, queries []string, args ...
 
 // Close release db connection resource, return it to BaseDB.db connection pool
 func (conn *DBConn) Close() error {
-	if conn == nil || conn.baseConn == nil {
+	if conn == nil || conn.getBaseConn() == nil {
 		return nil
 	}
-	return conn.baseConn.Close()
+	return conn.getBaseConn().Close()
 }
 
 func createConn(ctx context.Context, cfg *config.SubTaskConfig) (*conn.BaseDB, *DBConn, error) {
@@ -167,14 +279,18 @@ func createConn(ctx context.Context, cfg *config.SubTaskConfig) (*conn.BaseDB, *
 	if err != nil {
 		return nil, nil, terror.WithScope(terror.DBErrorAdapt(err, terror.ErrDBDriverError), terror.ScopeDownstream)
 	}
-	return baseDB, &DBConn{baseConn: baseConn, cfg: cfg}, nil
+	return baseDB, &DBConn{baseConn: baseConn, cfg: cfg, dialect: conn.DialectFor(cfg.To.Backend)}, nil
 }
 
-func createConns(tctx *tcontext.Context, cfg *config.SubTaskConfig, workerCount int) (*conn.BaseDB, []*DBConn, error) {
+func createConns(tctx *tcontext.Context, cfg *config.SubTaskConfig, workerCount int) (*conn.BaseDB, []*DBConn, *connPool, error) {
 	baseDB, err := conn.DefaultDBProvider.Apply(cfg.To)
 	if err != nil {
-		return nil, nil, terror.WithScope(terror.DBErrorAdapt(err, terror.ErrDBDriverError), terror.ScopeDownstream)
+		return nil, nil, nil, terror.WithScope(terror.DBErrorAdapt(err, terror.ErrDBDriverError), terror.ScopeDownstream)
 	}
+	if maxOpen := cfg.To.PoolPolicy.MaxOpen; maxOpen > 0 && maxOpen < workerCount {
+		workerCount = maxOpen
+	}
+	dialect := conn.DialectFor(cfg.To.Backend)
 	conns := make([]*DBConn, 0, workerCount)
 	for i := 0; i < workerCount; i++ {
 		baseConn, err := baseDB.GetBaseConn(tctx.Context())
@@ -183,23 +299,27 @@ func createConns(tctx *tcontext.Context, cfg *config.SubTaskConfig, workerCount
 			if terr != nil {
 				tctx.L().Error("failed to close baseDB", zap.Error(terr))
 			}
-			return nil, nil, terror.WithScope(terror.DBErrorAdapt(err, terror.ErrDBDriverError), terror.ScopeDownstream)
+			return nil, nil, nil, terror.WithScope(terror.DBErrorAdapt(err, terror.ErrDBDriverError), terror.ScopeDownstream)
 		}
-		conns = append(conns, &DBConn{baseConn: baseConn, cfg: cfg})
+		conns = append(conns, &DBConn{baseConn: baseConn, cfg: cfg, dialect: dialect})
 	}
-	return baseDB, conns, nil
+	pool := newConnPool(tctx, cfg, baseDB, dialect, conns)
+	return baseDB, conns, pool, nil
 }
 
+// isErrDBExists is only reached for the CREATE DATABASE statement the
+// loader issues up front, which is still MySQL/TiDB syntax regardless of
+// downstream; it isn't part of the Dialect abstraction.
 func isErrDBExists(err error) bool {
 	return isMySQLError(err, tmysql.ErrDBCreateExists)
 }
 
-func isErrTableExists(err error) bool {
-	return isMySQLError(err, tmysql.ErrTableExists)
+func (conn *DBConn) isErrTableExists(err error) bool {
+	return conn.dialect.IsTableExists(err)
 }
 
-func isErrDupEntry(err error) bool {
-	return isMySQLError(err, tmysql.ErrDupEntry)
+func (conn *DBConn) isErrDupEntry(err error) bool {
+	return conn.dialect.IsDuplicateEntry(err)
 }
 
 func isMySQLError(err error, code uint16) bool {
@@ -207,3 +327,12 @@ func isMySQLError(err error, code uint16) bool {
 	e, ok := err.(*mysql.MySQLError)
 	return ok && e.Number == code
 }
+
+// isErrStatementTimeout reports whether err is TiDB/MySQL's
+// ER_QUERY_TIMEOUT (raised when a statement exceeds MAX_EXECUTION_TIME),
+// or the per-attempt timeout context executeSQL wraps around writes
+// expiring first - both mean the statement itself ran too long, as
+// opposed to the connection being lost.
+func isErrStatementTimeout(err error) bool {
+	return isMySQLError(err, tmysql.ErrQueryTimeout) || errors.Cause(err) == context.DeadlineExceeded
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pingcap/dm/pkg/metricsproxy"
+)
+
+var (
+	// poolHealthyConnectionsGauge reports how many of a task's pool
+	// connections answered the last health probe.
+	poolHealthyConnectionsGauge = metricsproxy.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dm",
+			Subsystem: "loader",
+			Name:      "pool_healthy_connections",
+			Help:      "number of downstream connections that answered the loader's last health probe",
+		}, []string{"task"})
+
+	// poolEvictionsCounter counts connections the pool has evicted and
+	// rebuilt because the downstream dropped them.
+	poolEvictionsCounter = metricsproxy.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dm",
+			Subsystem: "loader",
+			Name:      "pool_evictions_total",
+			Help:      "total number of downstream connections evicted and rebuilt by the loader's pool",
+		}, []string{"task"})
+)
@@ -0,0 +1,205 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"database/sql/driver"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/dm/dm/config"
+	"github.com/pingcap/dm/pkg/conn"
+	tcontext "github.com/pingcap/dm/pkg/context"
+)
+
+// connPool owns the set of worker connections createConns hands out and
+// runs a background health probe that evicts and rebuilds connections
+// the downstream has dropped, per cfg.To.PoolPolicy. querySQL/executeSQL
+// also consult it directly when they see a bad-connection error, so a
+// dead connection doesn't have to wait for the next probe tick before
+// it's replaced.
+type connPool struct {
+	cfg     *config.SubTaskConfig
+	baseDB  *conn.BaseDB
+	dialect conn.Dialect
+
+	mu    sync.Mutex
+	conns []*DBConn
+	bad   map[int]int // conn index -> consecutive failed pings
+	// gen is bumped each time evictAndRebuildLocked rebuilds the
+	// connection at that index, so probeOnce can tell whether a
+	// connection it pinged with p.mu released was since evicted by a
+	// concurrent querySQL/executeSQL replace() call, and if so discard
+	// that now-stale ping result instead of acting on it.
+	gen []uint64
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newConnPool wraps conns in a connPool and, if cfg.To.PoolPolicy
+// enables it, starts the background health-probe loop.
+func newConnPool(tctx *tcontext.Context, cfg *config.SubTaskConfig, baseDB *conn.BaseDB, dialect conn.Dialect, conns []*DBConn) *connPool {
+	p := &connPool{
+		cfg:     cfg,
+		baseDB:  baseDB,
+		dialect: dialect,
+		conns:   conns,
+		bad:     make(map[int]int),
+		gen:     make([]uint64, len(conns)),
+		stopCh:  make(chan struct{}),
+	}
+	for i, c := range conns {
+		c.pool = p
+		c.poolIndex = i
+	}
+	if cfg.To.PoolPolicy.HealthProbeInterval > 0 {
+		p.wg.Add(1)
+		go p.probeLoop(tctx)
+	}
+	return p
+}
+
+func (p *connPool) probeLoop(tctx *tcontext.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.To.PoolPolicy.HealthProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-tctx.Context().Done():
+			return
+		case <-ticker.C:
+			p.probeOnce(tctx)
+		}
+	}
+}
+
+// probeOnce pings every connection in the pool. The ping I/O itself runs
+// with p.mu released, so a slow or hanging downstream connection mid-probe
+// doesn't stall querySQL/executeSQL's on-demand replace calls, which also
+// need p.mu, for the whole probe cycle.
+func (p *connPool) probeOnce(tctx *tcontext.Context) {
+	policy := p.cfg.To.PoolPolicy
+
+	p.mu.Lock()
+	conns := make([]*DBConn, len(p.conns))
+	copy(conns, p.conns)
+	gens := make([]uint64, len(p.gen))
+	copy(gens, p.gen)
+	p.mu.Unlock()
+
+	healthy := 0
+	for i, c := range conns {
+		if c == nil {
+			continue
+		}
+		baseConn := c.getBaseConn()
+		if baseConn == nil {
+			continue
+		}
+		rows, pingErr := baseConn.QuerySQL(tctx, "SELECT 1")
+		if rows != nil {
+			_ = rows.Close()
+		}
+
+		p.mu.Lock()
+		if p.gen[i] != gens[i] {
+			// The connection at i was evicted and rebuilt - e.g. by a
+			// concurrent querySQL/executeSQL replace() call - while this
+			// ping was in flight with p.mu released; that already
+			// resolved whatever this ping saw, so don't act on it.
+			p.mu.Unlock()
+			continue
+		}
+		if pingErr != nil {
+			p.bad[i]++
+			tctx.L().Warn("loader pool connection failed health probe",
+				zap.Int("conn", i), zap.Int("consecutiveFailures", p.bad[i]), zap.Error(pingErr))
+			if p.bad[i] >= policy.PingTimesBeforeEviction {
+				p.evictAndRebuildLocked(tctx, i)
+			}
+		} else {
+			delete(p.bad, i)
+			healthy++
+		}
+		p.mu.Unlock()
+	}
+	poolHealthyConnectionsGauge.WithLabelValues(p.cfg.Name).Set(float64(healthy))
+}
+
+// evictAndRebuildLocked closes the connection at i and rebuilds it with a
+// freshly dialed baseConn. The existing *DBConn is mutated in place
+// (rather than replacing the p.conns[i] slice entry with a new object) so
+// that a worker holding its own long-lived reference to that connection -
+// captured once from createConns's returned slice - observes the swap too,
+// instead of being left pointing at a closed connection until its next
+// query fails and triggers replace. Callers must hold p.mu.
+func (p *connPool) evictAndRebuildLocked(tctx *tcontext.Context, i int) {
+	p.gen[i]++
+	old := p.conns[i]
+	if old != nil {
+		_ = old.Close()
+	}
+	baseConn, err := p.baseDB.GetBaseConn(tctx.Context())
+	if err != nil {
+		tctx.L().Error("failed to rebuild evicted loader pool connection", zap.Int("conn", i), zap.Error(err))
+		if old != nil {
+			old.setBaseConn(nil)
+		}
+		return
+	}
+	if old != nil {
+		old.setBaseConn(baseConn)
+	} else {
+		p.conns[i] = &DBConn{cfg: p.cfg, baseConn: baseConn, dialect: p.dialect, pool: p, poolIndex: i}
+	}
+	delete(p.bad, i)
+	poolEvictionsCounter.WithLabelValues(p.cfg.Name).Inc()
+	tctx.L().Warn("evicted and rebuilt loader pool connection", zap.Int("conn", i))
+}
+
+// replace evicts and rebuilds the connection at index i, returning the
+// fresh one. Used by querySQL/executeSQL when a bad-connection error
+// suggests the pool's health probe hasn't caught up yet.
+func (p *connPool) replace(tctx *tcontext.Context, i int) *DBConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evictAndRebuildLocked(tctx, i)
+	return p.conns[i]
+}
+
+// Close stops the health-probe goroutine, if running, and waits for it
+// to exit.
+func (p *connPool) Close() {
+	close(p.stopCh)
+	p.wg.Wait()
+}
+
+// isErrBadConnection reports whether err indicates the underlying
+// network connection is gone, as opposed to a retryable-but-still-live
+// condition like a statement timeout. Matches the same
+// connection-level cases retry.IsRetryableError treats as transient, so a
+// connection that died with an EOF gets replaced with a fresh one just as
+// promptly as one that died with driver.ErrBadConn, instead of every
+// retry attempt hitting it again until the next health-probe tick.
+func isErrBadConnection(err error) bool {
+	err = errors.Cause(err)
+	return err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/pingcap/dm/dm/config"
+	tcontext "github.com/pingcap/dm/pkg/context"
+	"github.com/pingcap/dm/pkg/terror"
+)
+
+// BeginXA starts an XA transaction branch on this connection, identified
+// by xid. It must be followed by exactly one of PrepareXA+CommitXA or
+// RollbackXA.
+func (conn *DBConn) BeginXA(ctx *tcontext.Context, xid string) error {
+	return conn.executeSQL(ctx, []string{fmt.Sprintf("XA START '%s'", xid)})
+}
+
+// PrepareXA ends and prepares the XA branch started by BeginXA. Once
+// this returns successfully the branch is durable on the downstream and
+// can only be resolved by CommitXA or RollbackXA, even across a
+// connection loss.
+func (conn *DBConn) PrepareXA(ctx *tcontext.Context, xid string) error {
+	return conn.executeSQL(ctx, []string{
+		fmt.Sprintf("XA END '%s'", xid),
+		fmt.Sprintf("XA PREPARE '%s'", xid),
+	})
+}
+
+// CommitXA commits a previously prepared XA branch.
+func (conn *DBConn) CommitXA(ctx *tcontext.Context, xid string) error {
+	return conn.executeSQL(ctx, []string{fmt.Sprintf("XA COMMIT '%s'", xid)})
+}
+
+// RollbackXA rolls back a previously prepared XA branch.
+func (conn *DBConn) RollbackXA(ctx *tcontext.Context, xid string) error {
+	return conn.executeSQL(ctx, []string{fmt.Sprintf("XA ROLLBACK '%s'", xid)})
+}
+
+// RollbackActiveXA rolls back a branch that never reached PrepareXA - it's
+// still ACTIVE (BeginXA succeeded, nothing ended it yet), a state MySQL's
+// XA ROLLBACK rejects directly. XA END first moves it to IDLE, from which
+// the rollback is accepted. If XA END itself fails the branch may already
+// be IDLE (e.g. a failed PrepareXA got as far as its own XA END before
+// failing), so the rollback is attempted regardless.
+func (conn *DBConn) RollbackActiveXA(ctx *tcontext.Context, xid string) error {
+	if err := conn.executeSQL(ctx, []string{fmt.Sprintf("XA END '%s'", xid)}); err != nil {
+		ctx.L().Warn("XA END failed while rolling back an incomplete branch, branch may already be idle",
+			zap.String("xid", xid), zap.Error(err))
+	}
+	return conn.RollbackXA(ctx, xid)
+}
+
+// xaBranchState is the lifecycle state of one branch of a distributed
+// transaction, as recorded in the XA journal.
+type xaBranchState string
+
+const (
+	xaBranchPrepared   xaBranchState = "prepared"
+	xaBranchCommitted  xaBranchState = "committed"
+	xaBranchRolledBack xaBranchState = "rolled_back"
+)
+
+// xaJournalEntry is one journal record: a single branch of a global xid,
+// tied to the worker (by index into XACoordinator.conns) that owns it.
+type xaJournalEntry struct {
+	GlobalXID   string        `json:"global_xid"`
+	BranchIndex int           `json:"branch_index"`
+	State       xaBranchState `json:"state"`
+}
+
+// fileXAJournal is a file-backed, append-only XA journal: every state
+// transition is appended as a line of JSON, and the latest line per
+// (GlobalXID, BranchIndex) wins on replay. This plays the role an
+// etcd-backed journal would in a clustered deployment, at the cost of
+// being local to this worker's disk.
+type fileXAJournal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func newFileXAJournal(path string) (*fileXAJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, terror.ErrDBUnExpect.Generate(err.Error())
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, terror.ErrDBUnExpect.Generate(err.Error())
+	}
+	return &fileXAJournal{path: path, f: f}, nil
+}
+
+func (j *fileXAJournal) record(entry xaJournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return terror.ErrDBUnExpect.Generate(err.Error())
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return terror.ErrDBUnExpect.Generate(err.Error())
+	}
+	return j.f.Sync()
+}
+
+// latestByXID replays the journal and returns every branch's last
+// recorded state, grouped by GlobalXID, so a recovering coordinator can
+// tell a dangling branch (sibling still "prepared") apart from a torn
+// batch (one sibling already "committed" while this one is still
+// "prepared").
+func (j *fileXAJournal) latestByXID() (map[string][]xaJournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Seek(0, 0); err != nil {
+		return nil, terror.ErrDBUnExpect.Generate(err.Error())
+	}
+	latest := make(map[string]xaJournalEntry)
+	scanner := bufio.NewScanner(j.f)
+	for scanner.Scan() {
+		var entry xaJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", entry.GlobalXID, entry.BranchIndex)
+		latest[key] = entry
+	}
+	if _, err := j.f.Seek(0, 2); err != nil {
+		return nil, terror.ErrDBUnExpect.Generate(err.Error())
+	}
+
+	byXID := make(map[string][]xaJournalEntry)
+	for _, entry := range latest {
+		byXID[entry.GlobalXID] = append(byXID[entry.GlobalXID], entry)
+	}
+	return byXID, nil
+}
+
+func (j *fileXAJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// XACoordinator runs the loader's optional two-phase-commit mode: each
+// batch is assigned a global xid, applied to every worker connection as
+// one XA branch per connection, and only committed once every branch has
+// prepared successfully. Enabled via experimental.two-phase-commit.
+type XACoordinator struct {
+	cfg     *config.SubTaskConfig
+	conns   []*DBConn
+	journal *fileXAJournal
+	seq     uint64
+}
+
+// NewXACoordinator creates a coordinator over conns and, on startup,
+// resolves any branch left dangling by a previous crash. A crash can
+// happen partway through CommitBatch's per-branch commit loop, leaving
+// one global xid with some branches already committed and others still
+// "prepared" - so a dangling branch is only rolled back if none of its
+// siblings committed; otherwise it's committed too, to avoid a torn
+// batch.
+func NewXACoordinator(tctx *tcontext.Context, cfg *config.SubTaskConfig, conns []*DBConn, journalDir string) (*XACoordinator, error) {
+	journal, err := newFileXAJournal(filepath.Join(journalDir, cfg.Name+".xa.journal"))
+	if err != nil {
+		return nil, err
+	}
+	coord := &XACoordinator{cfg: cfg, conns: conns, journal: journal}
+	if err := coord.recoverDanglingBranches(tctx); err != nil {
+		return nil, err
+	}
+	return coord, nil
+}
+
+func (c *XACoordinator) recoverDanglingBranches(tctx *tcontext.Context) error {
+	byXID, err := c.journal.latestByXID()
+	if err != nil {
+		return err
+	}
+	for xid, branches := range byXID {
+		anyCommitted := false
+		for _, b := range branches {
+			if b.State == xaBranchCommitted {
+				anyCommitted = true
+				break
+			}
+		}
+
+		for _, entry := range branches {
+			if entry.State != xaBranchPrepared || entry.BranchIndex >= len(c.conns) {
+				continue
+			}
+
+			if anyCommitted {
+				// A sibling branch of this xid already committed, so
+				// rolling this one back would leave the batch torn
+				// (applied on some downstreams, not others). Replay the
+				// commit instead.
+				tctx.L().Warn("replaying commit for dangling XA branch whose sibling already committed",
+					zap.String("xid", xid), zap.Int("branch", entry.BranchIndex))
+				if err := c.conns[entry.BranchIndex].CommitXA(tctx, xid); err != nil {
+					tctx.L().Error("failed to commit dangling XA branch", zap.String("xid", xid), zap.Int("branch", entry.BranchIndex), zap.Error(err))
+					continue
+				}
+				if err := c.journal.record(xaJournalEntry{GlobalXID: xid, BranchIndex: entry.BranchIndex, State: xaBranchCommitted}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			tctx.L().Warn("rolling back dangling XA branch from a previous run",
+				zap.String("xid", xid), zap.Int("branch", entry.BranchIndex))
+			if err := c.conns[entry.BranchIndex].RollbackXA(tctx, xid); err != nil {
+				tctx.L().Error("failed to roll back dangling XA branch", zap.String("xid", xid), zap.Int("branch", entry.BranchIndex), zap.Error(err))
+				continue
+			}
+			if err := c.journal.record(xaJournalEntry{GlobalXID: xid, BranchIndex: entry.BranchIndex, State: xaBranchRolledBack}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NewGlobalXID assigns a fresh, process-unique global xid for one batch.
+func (c *XACoordinator) NewGlobalXID() string {
+	seq := atomic.AddUint64(&c.seq, 1)
+	return fmt.Sprintf("dm-%s-%d", c.cfg.Name, seq)
+}
+
+// CommitBatch runs work against every worker connection inside one XA
+// branch each, all sharing xid, and only commits once every branch has
+// prepared. If any worker fails to prepare, every branch that did
+// prepare is rolled back, and the branch that failed (which may still be
+// ACTIVE rather than prepared) is rolled back too, so the batch leaves no
+// partial effect and no branch dangling on the downstream.
+func (c *XACoordinator) CommitBatch(tctx *tcontext.Context, xid string, work func(i int, conn *DBConn) error) error {
+	prepared := make([]int, 0, len(c.conns))
+	for i, conn := range c.conns {
+		if err := conn.BeginXA(tctx, xid); err != nil {
+			return c.abort(tctx, xid, prepared, nil, err)
+		}
+		if err := work(i, conn); err != nil {
+			return c.abort(tctx, xid, prepared, []int{i}, err)
+		}
+		if err := conn.PrepareXA(tctx, xid); err != nil {
+			return c.abort(tctx, xid, prepared, []int{i}, err)
+		}
+		// The branch is now durably prepared on the downstream
+		// regardless of whether the journal write below succeeds, so it
+		// has to be in the cleanup list before that's even checked -
+		// otherwise a journal failure here would leave a prepared branch
+		// abort doesn't know to roll back and recoverDanglingBranches can
+		// never see, since nothing was ever journaled for it.
+		prepared = append(prepared, i)
+		if err := c.journal.record(xaJournalEntry{GlobalXID: xid, BranchIndex: i, State: xaBranchPrepared}); err != nil {
+			return c.abort(tctx, xid, prepared, nil, err)
+		}
+	}
+
+	for _, i := range prepared {
+		if err := c.conns[i].CommitXA(tctx, xid); err != nil {
+			// The branch is already durably prepared; log and let the
+			// next startup's recoverDanglingBranches retry the commit
+			// rather than rolling back a batch other branches already
+			// committed.
+			tctx.L().Error("failed to commit prepared XA branch", zap.String("xid", xid), zap.Int("branch", i), zap.Error(err))
+			continue
+		}
+		if err := c.journal.record(xaJournalEntry{GlobalXID: xid, BranchIndex: i, State: xaBranchCommitted}); err != nil {
+			tctx.L().Error("failed to record committed XA branch", zap.String("xid", xid), zap.Int("branch", i), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// abort rolls back every branch in prepared (already PREPARED, possibly
+// journaled) and every branch in active (still ACTIVE, never reached
+// PrepareXA), then returns an error wrapping cause. The two lists need
+// different rollback paths: MySQL's XA ROLLBACK rejects an ACTIVE branch
+// outright, so active branches go through RollbackActiveXA's XA END first.
+func (c *XACoordinator) abort(tctx *tcontext.Context, xid string, prepared, active []int, cause error) error {
+	for _, i := range active {
+		if err := c.conns[i].RollbackActiveXA(tctx, xid); err != nil {
+			tctx.L().Error("failed to roll back active XA branch after batch failure", zap.String("xid", xid), zap.Int("branch", i), zap.Error(err))
+		}
+	}
+	for _, i := range prepared {
+		if err := c.conns[i].RollbackXA(tctx, xid); err != nil {
+			tctx.L().Error("failed to roll back XA branch after batch failure", zap.String("xid", xid), zap.Int("branch", i), zap.Error(err))
+			continue
+		}
+		if err := c.journal.record(xaJournalEntry{GlobalXID: xid, BranchIndex: i, State: xaBranchRolledBack}); err != nil {
+			tctx.L().Error("failed to record rolled-back XA branch", zap.String("xid", xid), zap.Int("branch", i), zap.Error(err))
+		}
+	}
+	return terror.ErrDBUnExpect.Generate(fmt.Sprintf("XA batch %s aborted: %s", xid, cause))
+}
+
+// Close releases the coordinator's journal file handle.
+func (c *XACoordinator) Close() error {
+	return c.journal.close()
+}
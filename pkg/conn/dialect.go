@@ -0,0 +1,173 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"strings"
+
+	gmysql "github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	tmysql "github.com/pingcap/parser/mysql"
+
+	"github.com/pingcap/dm/pkg/retry"
+)
+
+// Dialect hides the downstream-specific error taxonomy and DDL quirks
+// behind a common interface, so the loader can restore a dump captured
+// from MySQL/TiDB into a different downstream without scattering
+// `*mysql.MySQLError` type assertions across the restore path.
+type Dialect interface {
+	// IsDuplicateEntry reports whether err is the downstream's duplicate
+	// primary/unique key violation.
+	IsDuplicateEntry(err error) bool
+	// IsTableExists reports whether err is the downstream's "table
+	// already exists" error.
+	IsTableExists(err error) bool
+	// IsRetryable reports whether err is worth retrying (e.g. a
+	// transient connection error), independent of go-sql-driver/mysql's
+	// error type.
+	IsRetryable(err error) bool
+	// QuoteIdent quotes an identifier (table/column name) the way this
+	// downstream expects.
+	QuoteIdent(s string) string
+	// RewriteDDL adapts a MySQL-flavored DDL statement (as produced by a
+	// dump taken from MySQL/TiDB) into one the downstream accepts, e.g.
+	// dropping `ENGINE=` table options or swapping backtick quoting for
+	// double quotes.
+	RewriteDDL(stmt string) string
+}
+
+// Backend names accepted by DialectFor, and used in DBConfig.Backend.
+const (
+	BackendMySQL    = "mysql"
+	BackendTiDB     = "tidb"
+	BackendMariaDB  = "mariadb"
+	BackendPostgres = "postgres"
+)
+
+// DialectFor returns the Dialect for the named downstream backend.
+// An empty or unrecognized name falls back to MySQL/TiDB, matching the
+// loader's historical behavior.
+func DialectFor(backend string) Dialect {
+	switch backend {
+	case BackendMariaDB:
+		return mariaDBDialect{}
+	case BackendPostgres:
+		return postgresDialect{}
+	default:
+		return mysqlDialect{}
+	}
+}
+
+// mysqlDialect also serves TiDB, which mirrors MySQL's error codes and
+// DDL syntax closely enough to share an implementation.
+type mysqlDialect struct{}
+
+func (mysqlDialect) IsDuplicateEntry(err error) bool {
+	return isMySQLErrCode(err, tmysql.ErrDupEntry)
+}
+
+func (mysqlDialect) IsTableExists(err error) bool {
+	return isMySQLErrCode(err, tmysql.ErrTableExists)
+}
+
+func (mysqlDialect) IsRetryable(err error) bool {
+	return retry.IsRetryableError(err)
+}
+
+func (mysqlDialect) QuoteIdent(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+func (mysqlDialect) RewriteDDL(stmt string) string {
+	return stmt
+}
+
+// mariaDBDialect reuses MySQL's error codes and quoting, which MariaDB
+// keeps wire-compatible, but strips options TiDB-dump DDL carries that
+// MariaDB rejects or ignores differently.
+type mariaDBDialect struct {
+	mysqlDialect
+}
+
+func (mariaDBDialect) RewriteDDL(stmt string) string {
+	return stripTableOption(stmt, "SHARD_ROW_ID_BITS")
+}
+
+// postgresDialect adapts MySQL-flavored dump DDL and error codes to
+// Postgres.
+type postgresDialect struct{}
+
+func (postgresDialect) IsDuplicateEntry(err error) bool {
+	return hasPgErrCode(err, "23505")
+}
+
+func (postgresDialect) IsTableExists(err error) bool {
+	return hasPgErrCode(err, "42P07")
+}
+
+func (postgresDialect) IsRetryable(err error) bool {
+	return hasPgErrCode(err, "57P03") || hasPgErrCode(err, "08006") || retry.IsRetryableError(err)
+}
+
+func (postgresDialect) QuoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func (postgresDialect) RewriteDDL(stmt string) string {
+	stmt = stripTableOption(stmt, "ENGINE")
+	// DEFAULT CHARSET must be stripped before the bare CHARSET option:
+	// stripTableOption matches on "KEY=", and "CHARSET=" also matches as
+	// a suffix of "DEFAULT CHARSET=", so stripping CHARSET first would
+	// leave a dangling DEFAULT token behind.
+	stmt = stripTableOption(stmt, "DEFAULT CHARSET")
+	stmt = stripTableOption(stmt, "CHARSET")
+	return strings.ReplaceAll(stmt, "`", `"`)
+}
+
+// stripTableOption removes a trailing `key=value`-style table option
+// (e.g. `ENGINE=InnoDB`) from a CREATE/ALTER TABLE statement; downstream
+// backends other than MySQL/TiDB don't understand these.
+func stripTableOption(stmt, key string) string {
+	idx := strings.Index(strings.ToUpper(stmt), strings.ToUpper(key)+"=")
+	if idx < 0 {
+		return stmt
+	}
+	end := strings.IndexAny(stmt[idx:], " \t\n;")
+	if end < 0 {
+		return strings.TrimRight(stmt[:idx], " \t\n")
+	}
+	return strings.TrimRight(stmt[:idx], " \t\n") + stmt[idx+end:]
+}
+
+func isMySQLErrCode(err error, code uint16) bool {
+	err = errors.Cause(err)
+	e, ok := err.(*gmysql.MySQLError)
+	return ok && e.Number == code
+}
+
+// hasPgErrCode reports whether err is a *pq.Error (or lib/pq-compatible
+// error) carrying the given SQLSTATE code. Checked by string rather than
+// importing the postgres driver, since the loader doesn't otherwise
+// depend on it.
+func hasPgErrCode(err error, code string) bool {
+	type pgError interface {
+		SQLState() string
+	}
+	err = errors.Cause(err)
+	if pe, ok := err.(pgError); ok {
+		return pe.SQLState() == code
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import "testing"
+
+func TestPostgresDialectRewriteDDL(t *testing.T) {
+	cases := []struct {
+		name string
+		stmt string
+		want string
+	}{
+		{
+			name: "engine and default charset",
+			stmt: "CREATE TABLE `t` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;",
+			want: `CREATE TABLE "t" ("a" int);`,
+		},
+		{
+			name: "bare charset without default",
+			stmt: "CREATE TABLE `t` (`a` int) CHARSET=utf8mb4;",
+			want: `CREATE TABLE "t" ("a" int);`,
+		},
+		{
+			name: "no table options",
+			stmt: "CREATE TABLE `t` (`a` int);",
+			want: `CREATE TABLE "t" ("a" int);`,
+		},
+	}
+
+	d := postgresDialect{}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := d.RewriteDDL(c.stmt); got != c.want {
+				t.Fatalf("RewriteDDL(%q) = %q, want %q", c.stmt, got, c.want)
+			}
+		})
+	}
+}
+
+func TestMariaDBDialectRewriteDDL(t *testing.T) {
+	stmt := "CREATE TABLE `t` (`a` int) SHARD_ROW_ID_BITS=4;"
+	want := "CREATE TABLE `t` (`a` int);"
+	if got := (mariaDBDialect{}).RewriteDDL(stmt); got != want {
+		t.Fatalf("RewriteDDL(%q) = %q, want %q", stmt, got, want)
+	}
+}
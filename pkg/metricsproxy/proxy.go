@@ -14,8 +14,11 @@
 package metricsproxy
 
 import (
-	"crypto/md5"
-	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -26,32 +29,62 @@ type Proxy interface {
 	vecDelete(prometheus.Labels) bool
 }
 
+// labelsMu guards every Proxy's labels map. It's a single package-level
+// lock rather than one per Proxy because GetLabels() hands back the
+// concrete type's plain map directly; a per-Proxy lock would need to
+// live alongside that map in each *VecProxy type instead.
+var labelsMu sync.Mutex
+
 // noteLabels common function in Proxy
 func noteLabels(proxy Proxy, labels map[string]string) {
-	labelsMd5 := getLabelsMd5(labels)
+	key := labelsKey(labels)
 
-	if _, ok := proxy.GetLabels()[labelsMd5]; !ok {
-		proxy.GetLabels()[labelsMd5] = labels
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	if _, ok := proxy.GetLabels()[key]; !ok {
+		proxy.GetLabels()[key] = labels
 	}
 }
 
-// getLabelsMd5 common function in Proxy
-func getLabelsMd5(labels map[string]string) string {
-	var str string
-	for _, label := range labels {
-		str += label
+// labelsKey builds a canonical key for labels: its sorted "key=value"
+// pairs joined with NUL, a byte that can't appear in a label key or
+// value, then hashed with fnv-1a. Sorting by key (rather than
+// concatenating values in map iteration order, which is also
+// unspecified) makes the key depend on both label names and values, so
+// e.g. {a: "xy", b: "z"} and {a: "x", b: "yz"} no longer collide.
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
 	}
-	return fmt.Sprintf("%x", md5.Sum([]byte(str)))
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(labels[k])
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(buf.String()))
+	return strconv.FormatUint(h.Sum64(), 16)
 }
 
 // findAndDeleteLabels common function in Proxy
 func findAndDeleteLabels(proxy Proxy, labels prometheus.Labels) bool {
 	var (
-		deleteLabelsList = make([]map[string]string, 0)
-		res              = true
+		deleteKeys = make([]string, 0)
+		res        = true
 	)
 	inputLabelsLen := len(labels)
-	for _, ls := range proxy.GetLabels() {
+
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	for key, ls := range proxy.GetLabels() {
 		t := 0
 		for k := range labels {
 			if ls[k] == labels[k] {
@@ -59,12 +92,29 @@ func findAndDeleteLabels(proxy Proxy, labels prometheus.Labels) bool {
 			}
 		}
 		if t == inputLabelsLen {
-			deleteLabelsList = append(deleteLabelsList, ls)
+			deleteKeys = append(deleteKeys, key)
 		}
 	}
 
-	for _, deleteLabels := range deleteLabelsList {
-		res = proxy.vecDelete(deleteLabels) && res
+	for _, key := range deleteKeys {
+		ls, ok := proxy.GetLabels()[key]
+		if !ok {
+			continue
+		}
+		res = proxy.vecDelete(ls) && res
+		delete(proxy.GetLabels(), key)
 	}
 	return res
 }
+
+// resetLabels common function in Proxy; concrete *VecProxy types can call
+// this from their own Reset()-style method to wipe tracked labels
+// cleanly when a subtask restarts, without leaking entries from the
+// previous run.
+func resetLabels(proxy Proxy) {
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	for key := range proxy.GetLabels() {
+		delete(proxy.GetLabels(), key)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metricsproxy
+
+import "testing"
+
+func TestLabelsKeyNoValueOnlyCollision(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b map[string]string
+	}{
+		{
+			name: "values shift across keys",
+			a:    map[string]string{"a": "xy", "b": "z"},
+			b:    map[string]string{"a": "x", "b": "yz"},
+		},
+		{
+			name: "different key set, same concatenated values",
+			a:    map[string]string{"a": "1", "b": "2"},
+			b:    map[string]string{"c": "1", "d": "2"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ka, kb := labelsKey(c.a), labelsKey(c.b)
+			if ka == kb {
+				t.Fatalf("labelsKey collided for distinct label sets %v and %v: both produced %q", c.a, c.b, ka)
+			}
+		})
+	}
+}
+
+func TestLabelsKeyStableAcrossIterationOrder(t *testing.T) {
+	labels := map[string]string{"task": "t1", "source_id": "s1", "schema": "db"}
+	want := labelsKey(labels)
+	for i := 0; i < 10; i++ {
+		if got := labelsKey(labels); got != want {
+			t.Fatalf("labelsKey not stable across calls: got %q, want %q", got, want)
+		}
+	}
+}
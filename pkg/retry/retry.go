@@ -0,0 +1,116 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry implements the backoff-and-retry strategy shared by dm's
+// DB operations.
+package retry
+
+import (
+	"database/sql/driver"
+	"io"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+
+	tcontext "github.com/pingcap/dm/pkg/context"
+	"github.com/pingcap/dm/pkg/terror"
+)
+
+// BackoffStrategy controls how the delay between retries grows.
+type BackoffStrategy int
+
+// Backoff strategies usable in Params.BackoffStrategy.
+const (
+	// Stable retries with the same delay every time.
+	Stable BackoffStrategy = iota
+	// LinearIncrease adds FirstRetryDuration to the delay on every
+	// retry.
+	LinearIncrease
+)
+
+// Params configures ApplyRetryStrategy.
+type Params struct {
+	RetryCount         int
+	FirstRetryDuration time.Duration
+	BackoffStrategy    BackoffStrategy
+	// IsRetryableFn decides, given the retry number (starting at 1) and
+	// the error from the latest attempt, whether another attempt should
+	// be made.
+	IsRetryableFn func(retryTime int, err error) bool
+}
+
+// ApplyRetryStrategy runs fn, retrying up to params.RetryCount times
+// with a delay chosen by params.BackoffStrategy while
+// params.IsRetryableFn allows it. It returns fn's last result, the
+// number of retries actually performed, and fn's last error.
+//
+// Unlike a plain retry loop, the backoff delay is interruptible: if ctx
+// is canceled while waiting between attempts, ApplyRetryStrategy returns
+// immediately with an ErrDBUnExpect terror whose message includes
+// ctx.Err(), instead of sleeping out the full backoff; that terror holds
+// only the message and does not wrap ctx.Err() itself. fn itself is also expected to honor ctx (e.g. via
+// QueryContext/ExecContext), so a cancellation aborts in-flight network
+// I/O too, not just future attempts.
+func ApplyRetryStrategy(ctx *tcontext.Context, params Params, fn func(*tcontext.Context) (interface{}, error)) (interface{}, int, error) {
+	var (
+		ret   interface{}
+		err   error
+		delay = params.FirstRetryDuration
+	)
+
+	for retryTime := 0; retryTime <= params.RetryCount; retryTime++ {
+		if ctxErr := ctx.Context().Err(); ctxErr != nil {
+			return ret, retryTime, terror.ErrDBUnExpect.Generate("retry canceled: " + ctxErr.Error())
+		}
+
+		ret, err = fn(ctx)
+		if err == nil {
+			return ret, retryTime, nil
+		}
+		if retryTime == params.RetryCount || params.IsRetryableFn == nil || !params.IsRetryableFn(retryTime+1, err) {
+			return ret, retryTime, err
+		}
+
+		select {
+		case <-ctx.Context().Done():
+			return ret, retryTime, terror.ErrDBUnExpect.Generate("retry canceled during backoff: " + ctx.Context().Err().Error())
+		case <-time.After(delay):
+		}
+		if params.BackoffStrategy == LinearIncrease {
+			delay += params.FirstRetryDuration
+		}
+	}
+	return ret, params.RetryCount, err
+}
+
+// IsRetryableError reports whether err looks like a transient
+// connection-level failure worth retrying, as opposed to e.g. a syntax
+// error or constraint violation that will fail on every attempt.
+func IsRetryableError(err error) bool {
+	err = errors.Cause(err)
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(*mysql.MySQLError); ok {
+		// MySQL errors are classified per-dialect by pkg/conn.Dialect;
+		// a *mysql.MySQLError reaching here is a definite server
+		// response, not a connection problem, so it isn't retryable by
+		// default.
+		return false
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tcontext "github.com/pingcap/dm/pkg/context"
+	"github.com/pingcap/dm/pkg/log"
+)
+
+// TestApplyRetryStrategyHonorsContextCancellation exercises cancellation
+// through ApplyRetryStrategy's actual backoff wait, not just its upfront
+// context check: FirstRetryDuration is long enough that the test would
+// hang were the backoff sleep not interruptible by ctx.Done().
+func TestApplyRetryStrategyHonorsContextCancellation(t *testing.T) {
+	stdCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx := tcontext.NewContext(stdCtx, log.L())
+
+	calls := 0
+	params := Params{
+		RetryCount:         10,
+		FirstRetryDuration: time.Minute,
+		BackoffStrategy:    Stable,
+		IsRetryableFn: func(retryTime int, err error) bool {
+			return true
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := ApplyRetryStrategy(ctx, params, func(ctx *tcontext.Context) (interface{}, error) {
+			calls++
+			if calls == 1 {
+				cancel()
+			}
+			return nil, errors.New("always fails")
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected ApplyRetryStrategy to return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ApplyRetryStrategy did not honor context cancellation during backoff")
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected exactly 1 call before cancellation, got %d", calls)
+	}
+}
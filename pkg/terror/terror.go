@@ -0,0 +1,114 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package terror defines the error codes and classes used across dm
+// components, so callers can branch on a stable code instead of matching
+// on error strings.
+package terror
+
+import "fmt"
+
+// ErrClass groups related error codes together, roughly by component.
+type ErrClass int
+
+// Error classes used by the errors defined in this package.
+const (
+	ClassDatabase ErrClass = iota
+	ClassLoader
+)
+
+// ErrCode uniquely identifies an error within its ErrClass.
+type ErrCode int
+
+// Error codes referenced from the loader and its DB layer.
+const (
+	codeDBUnExpect ErrCode = iota
+	codeDBDriverError
+	codeLoadStatementTimeout
+)
+
+// Error is a dm error that carries a stable class/code pair in addition
+// to a human-readable message.
+type Error struct {
+	class   ErrClass
+	code    ErrCode
+	message string
+}
+
+// New creates an Error template; call Generate on it to attach a
+// specific instance's arguments.
+func New(code ErrCode, class ErrClass, message string) *Error {
+	return &Error{class: class, code: code, message: message}
+}
+
+// Generate creates an error carrying this template's class/code, with
+// message arguments filled in.
+func (e *Error) Generate(args ...interface{}) error {
+	return &Error{class: e.class, code: e.code, message: fmt.Sprintf(e.message, args...)}
+}
+
+// Error returns the error's message, so an *Error returned by Generate
+// satisfies the error interface.
+func (e *Error) Error() string {
+	return e.message
+}
+
+// Code returns the error's code, so callers can branch on it.
+func (e *Error) Code() ErrCode {
+	return e.code
+}
+
+// Error codes used elsewhere in dm (db connection setup).
+var (
+	ErrDBUnExpect    = New(codeDBUnExpect, ClassDatabase, "%s")
+	ErrDBDriverError = New(codeDBDriverError, ClassDatabase, "database driver error: %s")
+
+	// ErrLoadStatementTimeout means a load statement repeatedly hit the
+	// configured StatementTimeout and exhausted its retries, as opposed
+	// to failing because the downstream connection was lost.
+	ErrLoadStatementTimeout = New(codeLoadStatementTimeout, ClassLoader, "statement execution exceeded MAX_EXECUTION_TIME(%ds) after %d retries")
+)
+
+// Scope marks which side of a task an error originated on, so logs and
+// alerts can tell an upstream (source) problem from a downstream (sink)
+// one at a glance.
+type Scope string
+
+// Scopes used when annotating errors returned from DB setup.
+const (
+	ScopeUpstream   Scope = "upstream"
+	ScopeDownstream Scope = "downstream"
+)
+
+type scopedError struct {
+	error
+	scope Scope
+}
+
+// WithScope annotates err with scope, if err is non-nil.
+func WithScope(err error, scope Scope) error {
+	if err == nil {
+		return nil
+	}
+	return &scopedError{error: err, scope: scope}
+}
+
+// DBErrorAdapt adapts a raw database/driver error into a dm Error using
+// the given template, carrying err's message. The original error value
+// is not kept, so errors.Cause on the result does not return err.
+func DBErrorAdapt(err error, tmpl *Error) error {
+	if err == nil {
+		return nil
+	}
+	return tmpl.Generate(err.Error())
+}